@@ -1,22 +1,389 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/nov1n/CCAssignment/src/cloud"
+)
+
+// orphanReapInterval is how often API.Serve checks for orphaned instances.
+const orphanReapInterval = 5 * time.Minute
+
+// orphanMaxAge is how old an orphaned instance must be before ReapOrphans
+// terminates it outright, even if its job still exists.
+const orphanMaxAge = 24 * time.Hour
+
+// shutdownTimeout bounds how long Serve waits for in-flight requests (and
+// StartJob calls) to finish once a shutdown is requested.
+const shutdownTimeout = 30 * time.Second
 
 // API is the object that is responsible for serving the API
 type API struct {
-	Port string
+	Port    string
+	Manager *Manager
+
+	hub    *eventHub
+	server *http.Server
+
+	// ctx is cancelled once Serve starts shutting down, so StartJob calls
+	// spawned by handleCreateJob are cancelled instead of running un-tracked
+	// past server shutdown.
+	ctx context.Context
+
+	// jobs tracks StartJob calls spawned by handleCreateJob, so Serve can
+	// wait for them to finish (or be cancelled) before returning.
+	jobs sync.WaitGroup
 }
 
-// NewAPI creates a new instance of the API
-func NewAPI(port string) {
+// NewAPI creates a new instance of the API.
+func NewAPI(port string, manager *Manager) *API {
 	return &API{
-		Port: port,
+		Port:    port,
+		Manager: manager,
+		hub:     newEventHub(),
+		ctx:     context.Background(),
+	}
+}
+
+// Serve starts a webserver with the different handlers. It blocks until ctx
+// is cancelled or SIGINT/SIGTERM is received, at which point it gracefully
+// shuts down: in-flight requests are drained, then any StartJob calls
+// spawned by handleCreateJob are given until shutdownTimeout to finish (or
+// be cancelled) before Serve returns.
+func (api *API) Serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	api.ctx = ctx
+
+	go api.reapOrphansPeriodically(ctx)
+
+	api.server = &http.Server{Addr: api.Port, Handler: api.routes()}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if err := api.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			serveErr <- err
+			return
+		}
+		serveErr <- nil
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-sigCh:
+		fmt.Println("shutting down...")
+	case <-ctx.Done():
+		fmt.Println("shutting down...")
+	}
+
+	// Cancel any in-flight StartJob calls before waiting for them, so they
+	// don't block shutdown on e.g. a slow SSH retry loop.
+	cancel()
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+
+	if err := api.server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+
+	jobsDone := make(chan struct{})
+	go func() {
+		api.jobs.Wait()
+		close(jobsDone)
+	}()
+
+	select {
+	case <-jobsDone:
+	case <-shutdownCtx.Done():
+		fmt.Println("shutdownTimeout elapsed with StartJob calls still in flight")
+	}
+	return nil
+}
+
+// routes builds the router, with request logging and panic recovery applied
+// to every handler.
+func (api *API) routes() http.Handler {
+	r := mux.NewRouter()
+	r.Use(loggingMiddleware)
+	r.Use(recoveryMiddleware)
+
+	r.HandleFunc("/jobs", api.handleCreateJob).Methods(http.MethodPost)
+	r.HandleFunc("/jobs", api.handleListJobs).Methods(http.MethodGet)
+	r.HandleFunc("/jobs/{id}", api.handleGetJob).Methods(http.MethodGet)
+	r.HandleFunc("/jobs/{id}", api.handleStopJob).Methods(http.MethodDelete)
+	r.HandleFunc("/jobs/{id}/events", api.handleJobEvents).Methods(http.MethodGet)
+
+	return r
+}
+
+// reapOrphansPeriodically runs Manager.ReapOrphans on a ticker, so instances
+// left behind by a crashed Manager process eventually get cleaned up.
+func (api *API) reapOrphansPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(orphanReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := api.Manager.ReapOrphans(ctx, orphanMaxAge); err != nil {
+				fmt.Printf("orphan reaper: %v\n", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// createJobRequest is the JSON body accepted by POST /jobs.
+type createJobRequest struct {
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	Capacity  int    `json:"capacity"`
+	Timelimit int    `json:"timelimit"`
+	Hash      string `json:"hash"`
+	HashType  string `json:"hash_type"`
+}
+
+// handleCreateJob creates a job and starts it in the background, returning
+// immediately with the created job. Its workers' progress can be followed on
+// GET /jobs/{id}/events.
+func (api *API) handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	var req createJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job := &Job{
+		Id:        newJobID(),
+		Name:      req.Name,
+		Email:     req.Email,
+		Capacity:  req.Capacity,
+		Timelimit: req.Timelimit,
+		Workers:   make(map[string]*Worker),
+		Hash:      req.Hash,
+		HashType:  req.HashType,
+	}
+
+	progress := make(chan WorkerEvent, job.Capacity)
+	go api.hub.broadcastFrom(job.Id, progress)
+
+	api.jobs.Add(1)
+	go func() {
+		defer api.jobs.Done()
+		defer close(progress)
+		if err := api.Manager.StartJob(api.ctx, job, progress); err != nil {
+			if code, ok := cloud.APIErrorCode(err); ok {
+				fmt.Printf("%s: failed to start job (%s): %v\n", job.Id, code, err)
+			} else {
+				fmt.Printf("%s: failed to start job: %v\n", job.Id, err)
+			}
+		}
+	}()
+
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// handleListJobs lists every job currently known to the Manager.
+func (api *API) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.Manager.ListJobs())
+}
+
+// handleGetJob returns a single job by id.
+func (api *API) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := api.Manager.GetJob(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
 	}
+	writeJSON(w, http.StatusOK, job)
 }
 
-// Serve starts a webserver with the different handlers
-func (api *API) Serve() error {
-	http.HandleFunc("/", rootHandler)
-	err := http.ListenAndServe(api.Port, nil)
-	return err
+// handleStopJob stops a job and its workers.
+func (api *API) handleStopJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := api.Manager.lookupJob(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	if err := api.Manager.StopJob(r.Context(), job); err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// statusForError maps err to an HTTP status code, using cloud.APIErrorCode to
+// distinguish AWS throttling (429) and authorization (403) failures from
+// everything else (500).
+func statusForError(err error) int {
+	code, ok := cloud.APIErrorCode(err)
+	if !ok {
+		return http.StatusInternalServerError
+	}
+
+	switch code {
+	case "RequestLimitExceeded", "Throttling", "ThrottlingException", "TooManyRequestsException":
+		return http.StatusTooManyRequests
+	case "UnauthorizedOperation", "AuthFailure", "AccessDenied", "AccessDeniedException":
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// handleJobEvents streams a job's worker state transitions (created,
+// ssh-ready, command-output, terminated) as Server-Sent Events, for as long
+// as the client stays connected.
+func (api *API) handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sub := api.hub.subscribe(id)
+	defer api.hub.unsubscribe(id, sub)
+
+	for {
+		select {
+		case event, ok := <-sub:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.State, data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// newJobID returns a random hex id for a new job.
+func newJobID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// loggingMiddleware logs every request's method, path and duration.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		fmt.Printf("%s %s %v\n", r.Method, r.URL.Path, time.Since(start))
+	})
+}
+
+// recoveryMiddleware turns a panic in a handler into a 500 response instead
+// of taking down the whole server.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				fmt.Printf("panic handling %s %s: %v\n", r.Method, r.URL.Path, err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// eventHub fans a job's WorkerEvents out to every subscriber currently
+// streaming that job's GET /jobs/{id}/events.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan WorkerEvent]struct{}
+}
+
+// newEventHub returns a new, empty eventHub.
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[string]map[chan WorkerEvent]struct{})}
+}
+
+// subscribe registers a new subscriber for jobID's events.
+func (h *eventHub) subscribe(jobID string) chan WorkerEvent {
+	ch := make(chan WorkerEvent, 16)
+
+	h.mu.Lock()
+	if h.subs[jobID] == nil {
+		h.subs[jobID] = make(map[chan WorkerEvent]struct{})
+	}
+	h.subs[jobID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch
+}
+
+// unsubscribe removes and closes a subscriber channel returned by subscribe.
+func (h *eventHub) unsubscribe(jobID string, ch chan WorkerEvent) {
+	h.mu.Lock()
+	delete(h.subs[jobID], ch)
+	if len(h.subs[jobID]) == 0 {
+		delete(h.subs, jobID)
+	}
+	h.mu.Unlock()
+
+	close(ch)
+}
+
+// publish fans event out to every current subscriber of jobID, dropping it
+// for any subscriber whose buffer is full rather than blocking.
+func (h *eventHub) publish(jobID string, event WorkerEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs[jobID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// broadcastFrom republishes every event sent on progress to jobID's
+// subscribers until progress is closed.
+func (h *eventHub) broadcastFrom(jobID string, progress <-chan WorkerEvent) {
+	for event := range progress {
+		h.publish(jobID, event)
+	}
 }
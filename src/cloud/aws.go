@@ -0,0 +1,152 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// instanceRunningMaxWait bounds how long WaitUntilRunning waits for an
+// instance to reach the running state.
+const instanceRunningMaxWait = 5 * time.Minute
+
+// AWSClient is the VMClient implementation backed by EC2.
+type AWSClient struct {
+	svc *ec2.Client
+}
+
+// NewAWSClient returns a new AWSClient for the given region.
+func NewAWSClient(ctx context.Context, region string) (*AWSClient, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	return &AWSClient{svc: ec2.NewFromConfig(cfg)}, nil
+}
+
+// RunInstance creates and returns an EC2 instance, stamped with tags.
+func (c *AWSClient) RunInstance(ctx context.Context, tags map[string]string) (*Instance, error) {
+	params := &ec2.RunInstancesInput{
+		ImageId:          aws.String(os.Getenv("IMG_ID")),
+		InstanceType:     types.InstanceType(os.Getenv("INST_TYPE")),
+		MaxCount:         aws.Int32(1),
+		MinCount:         aws.Int32(1),
+		KeyName:          aws.String(os.Getenv("PEM_NAME")),
+		SecurityGroupIds: []string{os.Getenv("SEC_GROUP")},
+	}
+	if len(tags) > 0 {
+		params.TagSpecifications = []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeInstance,
+				Tags:         ec2Tags(tags),
+			},
+		}
+	}
+
+	res, err := c.svc.RunInstances(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	inst := res.Instances[0]
+	fmt.Printf("%s: created new instance.\n", *inst.InstanceId)
+	return &Instance{Id: *inst.InstanceId, Tags: tags}, nil
+}
+
+// TerminateInstance terminates the EC2 instance with the given id.
+func (c *AWSClient) TerminateInstance(ctx context.Context, id string) error {
+	input := &ec2.TerminateInstancesInput{
+		InstanceIds: []string{id},
+	}
+	_, err := c.svc.TerminateInstances(ctx, input)
+	return err
+}
+
+// DescribeInstance returns the EC2 instance with the given id.
+func (c *AWSClient) DescribeInstance(ctx context.Context, id string) (*Instance, error) {
+	params := describeByIdParams(id)
+
+	resp, err := c.svc.DescribeInstances(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, res := range resp.Reservations {
+		for _, inst := range res.Instances {
+			return instanceFromEC2(inst), nil
+		}
+	}
+
+	return nil, fmt.Errorf("Could not find running instance.")
+}
+
+// WaitUntilRunning blocks until the EC2 instance with the given id is
+// running, ctx is cancelled, or instanceRunningMaxWait elapses.
+func (c *AWSClient) WaitUntilRunning(ctx context.Context, id string) error {
+	waiter := ec2.NewInstanceRunningWaiter(c.svc)
+	return waiter.Wait(ctx, describeByIdParams(id), instanceRunningMaxWait)
+}
+
+// ListInstancesByTag returns every EC2 instance that has the given tag key set.
+func (c *AWSClient) ListInstancesByTag(ctx context.Context, key string) ([]*Instance, error) {
+	params := &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("tag-key"),
+				Values: []string{key},
+			},
+		},
+	}
+
+	resp, err := c.svc.DescribeInstances(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []*Instance
+	for _, res := range resp.Reservations {
+		for _, inst := range res.Instances {
+			instances = append(instances, instanceFromEC2(inst))
+		}
+	}
+	return instances, nil
+}
+
+func describeByIdParams(id string) *ec2.DescribeInstancesInput {
+	return &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("instance-id"),
+				Values: []string{id},
+			},
+		},
+	}
+}
+
+func instanceFromEC2(inst types.Instance) *Instance {
+	i := &Instance{Id: *inst.InstanceId}
+	if inst.PublicIpAddress != nil {
+		i.PublicIPAddress = *inst.PublicIpAddress
+	}
+	if len(inst.Tags) > 0 {
+		i.Tags = make(map[string]string, len(inst.Tags))
+		for _, tag := range inst.Tags {
+			i.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+	return i
+}
+
+func ec2Tags(tags map[string]string) []types.Tag {
+	out := make([]types.Tag, 0, len(tags))
+	for k, v := range tags {
+		out = append(out, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return out
+}
@@ -0,0 +1,34 @@
+// Package cloud abstracts the VM operations the Manager needs away from any
+// particular cloud provider, so the manager can be tested without hitting AWS.
+package cloud
+
+import "context"
+
+// Instance is a minimal, provider-agnostic description of a running VM.
+type Instance struct {
+	Id              string
+	PublicIPAddress string
+	Tags            map[string]string
+}
+
+// VMClient is the set of VM operations the Manager relies on. AWSClient is the
+// real implementation; FakeClient is an in-memory stand-in for tests. Every
+// operation takes a context.Context so callers can cancel a job mid-launch.
+type VMClient interface {
+	// RunInstance creates a new instance, stamped with the given tags, and
+	// returns it in the "pending" state.
+	RunInstance(ctx context.Context, tags map[string]string) (*Instance, error)
+
+	// TerminateInstance terminates the instance with the given id.
+	TerminateInstance(ctx context.Context, id string) error
+
+	// DescribeInstance returns the current state of the instance with the given id.
+	DescribeInstance(ctx context.Context, id string) (*Instance, error)
+
+	// WaitUntilRunning blocks until the instance with the given id is running,
+	// ctx is cancelled, or the provider-specific max wait time elapses.
+	WaitUntilRunning(ctx context.Context, id string) error
+
+	// ListInstancesByTag returns every instance that has the given tag key set.
+	ListInstancesByTag(ctx context.Context, key string) ([]*Instance, error)
+}
@@ -0,0 +1,18 @@
+package cloud
+
+import (
+	"errors"
+
+	"github.com/aws/smithy-go"
+)
+
+// APIErrorCode returns the AWS error code for err (e.g. "RequestLimitExceeded",
+// "UnauthorizedOperation") and true if err is an API-level smithy.APIError, so
+// callers can distinguish quota/throttling from auth failures.
+func APIErrorCode(err error) (string, bool) {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode(), true
+	}
+	return "", false
+}
@@ -0,0 +1,155 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// instanceState is the lifecycle of a fake instance.
+type instanceState string
+
+const (
+	statePending    instanceState = "pending"
+	stateRunning    instanceState = "running"
+	stateTerminated instanceState = "terminated"
+)
+
+type fakeInstance struct {
+	id    string
+	state instanceState
+	tags  map[string]string
+}
+
+// FakeClient is an in-memory VMClient for tests. It tracks instance state
+// transitions (pending -> running -> terminated) and can be configured to
+// delay the transition to running or inject errors, to exercise the Manager's error
+// handling without talking to AWS.
+type FakeClient struct {
+	mu        sync.Mutex
+	instances map[string]*fakeInstance
+	nextID    int
+
+	// RunDelay is how long WaitUntilRunning sleeps before marking an
+	// instance running. Zero means the transition is immediate.
+	RunDelay time.Duration
+
+	// RunInstanceErr, when set, is returned by RunInstance instead of
+	// creating an instance.
+	RunInstanceErr error
+
+	// TerminateInstanceErr, when set, is returned by TerminateInstance
+	// instead of terminating the instance.
+	TerminateInstanceErr error
+}
+
+// NewFakeClient returns a new FakeClient with no instances.
+func NewFakeClient() *FakeClient {
+	return &FakeClient{
+		instances: make(map[string]*fakeInstance),
+	}
+}
+
+// RunInstance creates a fake instance in the "pending" state, stamped with tags.
+func (c *FakeClient) RunInstance(ctx context.Context, tags map[string]string) (*Instance, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.RunInstanceErr != nil {
+		return nil, c.RunInstanceErr
+	}
+
+	c.nextID++
+	id := fmt.Sprintf("fake-instance-%d", c.nextID)
+	c.instances[id] = &fakeInstance{id: id, state: statePending, tags: tags}
+	return &Instance{Id: id, Tags: tags}, nil
+}
+
+// TerminateInstance marks the fake instance as terminated.
+func (c *FakeClient) TerminateInstance(ctx context.Context, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.TerminateInstanceErr != nil {
+		return c.TerminateInstanceErr
+	}
+
+	inst, ok := c.instances[id]
+	if !ok {
+		return fmt.Errorf("fake: unknown instance %q", id)
+	}
+	inst.state = stateTerminated
+	return nil
+}
+
+// DescribeInstance returns the current state of the fake instance.
+func (c *FakeClient) DescribeInstance(ctx context.Context, id string) (*Instance, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	inst, ok := c.instances[id]
+	if !ok {
+		return nil, fmt.Errorf("Could not find running instance.")
+	}
+
+	out := &Instance{Id: inst.id, Tags: inst.tags}
+	if inst.state == stateRunning {
+		out.PublicIPAddress = "127.0.0.1"
+	}
+	return out, nil
+}
+
+// IsTerminated reports whether the fake instance with the given id has been
+// terminated. It exists purely so tests can assert on FakeClient state.
+func (c *FakeClient) IsTerminated(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	inst, ok := c.instances[id]
+	return ok && inst.state == stateTerminated
+}
+
+// ListInstancesByTag returns every fake instance that has the given tag key set.
+func (c *FakeClient) ListInstancesByTag(ctx context.Context, key string) ([]*Instance, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var instances []*Instance
+	for _, inst := range c.instances {
+		if _, ok := inst.tags[key]; !ok {
+			continue
+		}
+		out := &Instance{Id: inst.id, Tags: inst.tags}
+		if inst.state == stateRunning {
+			out.PublicIPAddress = "127.0.0.1"
+		}
+		instances = append(instances, out)
+	}
+	return instances, nil
+}
+
+// WaitUntilRunning waits RunDelay (or until ctx is cancelled) and then
+// transitions the instance to running.
+func (c *FakeClient) WaitUntilRunning(ctx context.Context, id string) error {
+	c.mu.Lock()
+	inst, ok := c.instances[id]
+	delay := c.RunDelay
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("fake: unknown instance %q", id)
+	}
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	c.mu.Lock()
+	inst.state = stateRunning
+	c.mu.Unlock()
+	return nil
+}
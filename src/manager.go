@@ -1,229 +1,427 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"strings"
+	"sync"
 	"time"
 
-	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nov1n/CCAssignment/src/cloud"
+	"github.com/nov1n/CCAssignment/src/multistep"
 )
 
+// defaultMaxParallelLaunches bounds how many workers a Manager launches or
+// tears down at once when MaxParallelLaunches isn't set.
+const defaultMaxParallelLaunches = 5
+
+// WorkerState describes a worker's lifecycle transitions as reported through
+// the progress channel passed to StartJob.
+type WorkerState string
+
+const (
+	// WorkerCreated means the worker's instance was created; it may not be
+	// running yet.
+	WorkerCreated WorkerState = "created"
+	// WorkerSSHReady means the worker's instance accepted an SSH connection
+	// and is ready to run commands.
+	WorkerSSHReady WorkerState = "ssh-ready"
+	// WorkerCommandOutput means a command finished running on the worker;
+	// WorkerEvent.Output holds its collected stdout.
+	WorkerCommandOutput WorkerState = "command-output"
+	// WorkerFailed means the worker could not be created or provisioned.
+	WorkerFailed WorkerState = "failed"
+	// WorkerTerminated means the worker's instance was terminated.
+	WorkerTerminated WorkerState = "terminated"
+)
+
+// WorkerEvent reports a worker's state transition during StartJob, including
+// the rollback of a failed start. StopJob reports no events.
+type WorkerEvent struct {
+	JobId    string
+	WorkerId string
+	State    WorkerState
+	Err      error
+	// Output holds a command's collected stdout, set only on
+	// WorkerCommandOutput events.
+	Output string
+}
+
 // Manager manages the workers and the jobs.
 type Manager struct {
-	EC2Svc *ec2.EC2
+	Client cloud.VMClient
 	Jobs   map[string]*Job
+
+	// MaxParallelLaunches bounds how many workers are launched or torn down
+	// concurrently. Zero means defaultMaxParallelLaunches.
+	MaxParallelLaunches int
+
+	// provision runs a worker's SSH pipeline. It defaults to
+	// provisionWorker, but is a field rather than a direct call so tests
+	// can stub out SSH provisioning against a VMClient that has no real
+	// instance to connect to.
+	provision func(ctx context.Context, job *Job, w *Worker, commands []string, progress chan<- WorkerEvent) ([]string, error)
+
+	// mu guards Jobs and every Job's Workers map, both of which are read by
+	// API handlers and mutated by StartJob/StopJob/ReapOrphans from other
+	// goroutines.
+	mu sync.RWMutex
 }
 
-// NewManager returns a new Manager struct.
-func NewManager(region *string) *Manager {
-	svc := ec2.New(session.New(), &aws.Config{Region: region})
-	return &Manager{
-		EC2Svc: svc,
+// NewManager returns a new Manager struct backed by the given VMClient.
+func NewManager(client cloud.VMClient) *Manager {
+	man := &Manager{
+		Client: client,
 		Jobs:   make(map[string]*Job),
 	}
+	man.provision = man.provisionWorker
+	return man
 }
 
-// createWorker starts a new EC2 instance.
-// It returns when the worker is ready.
-func (man *Manager) createWorker() (*Worker, error) {
-	inst, err := man.createInstance()
-	if err != nil {
-		return nil, err
+// GetJob returns a copy of the job with the given id, safe to read or
+// serialize without racing StartJob/StopJob/ReapOrphans.
+func (man *Manager) GetJob(id string) (*Job, bool) {
+	man.mu.RLock()
+	defer man.mu.RUnlock()
+
+	job, ok := man.Jobs[id]
+	if !ok {
+		return nil, false
 	}
+	return copyJob(job), true
+}
 
-	// Wait until the instance is up and running
-	params := &ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{
-			&ec2.Filter{
-				Name:   aws.String("instance-id"),
-				Values: []*string{inst.InstanceId},
-			},
-		},
+// ListJobs returns a copy of every job known to the manager, safe to read or
+// serialize without racing StartJob/StopJob/ReapOrphans.
+func (man *Manager) ListJobs() []*Job {
+	man.mu.RLock()
+	defer man.mu.RUnlock()
+
+	jobs := make([]*Job, 0, len(man.Jobs))
+	for _, job := range man.Jobs {
+		jobs = append(jobs, copyJob(job))
 	}
+	return jobs
+}
 
-	fmt.Printf("%s: waiting to be ready...\n", *inst.InstanceId)
-	man.EC2Svc.WaitUntilInstanceRunning(params)
-	fmt.Printf("%s: instance ready.\n", *inst.InstanceId)
+// lookupJob returns the live *Job with the given id (not a copy from
+// GetJob), for callers that need to act on it, such as StopJob.
+func (man *Manager) lookupJob(id string) (*Job, bool) {
+	man.mu.RLock()
+	defer man.mu.RUnlock()
 
-	return &Worker{
-		Id: *inst.InstanceId,
-	}, nil
+	job, ok := man.Jobs[id]
+	return job, ok
 }
 
-// startWorker sets up the Woker and starts working
-func (man *Manager) startWorker(w *Worker) error {
-	// man.runCmd([]string{"command1", "command2", "command3"})
-	return nil
+// copyJob returns a shallow copy of job with its own copy of the Workers
+// map, so the original can keep being mutated concurrently.
+func copyJob(job *Job) *Job {
+	workers := make(map[string]*Worker, len(job.Workers))
+	for id, w := range job.Workers {
+		workers[id] = w
+	}
+	cp := *job
+	cp.Workers = workers
+	return &cp
 }
 
-// stopWorker stops a worker (running EC2 instance).
-func (man *Manager) stopWorker(worker *Worker) error {
-	fmt.Printf("%s: stopping worker.\n", worker.Id)
-	input := &ec2.TerminateInstancesInput{
-		InstanceIds: []*string{aws.String(worker.Id)},
+// maxParallelLaunches returns man.MaxParallelLaunches, or the default if unset.
+func (man *Manager) maxParallelLaunches() int {
+	if man.MaxParallelLaunches > 0 {
+		return man.MaxParallelLaunches
 	}
-	_, err := man.EC2Svc.TerminateInstances(input)
-	return err
+	return defaultMaxParallelLaunches
 }
 
-// StartJob starts a job and starts the necessary workers
-func (man *Manager) StartJob(job *Job) error {
-	fmt.Printf("%s: starting job.\n", job.Id)
-	var errors []string
+// sendProgress reports a worker event on progress, if one was given.
+func sendProgress(progress chan<- WorkerEvent, jobID, workerID string, state WorkerState, err error) {
+	if progress == nil {
+		return
+	}
+	progress <- WorkerEvent{JobId: jobID, WorkerId: workerID, State: state, Err: err}
+}
 
-	// Create and start a number of Workers equal to the capacity of the job
-	for i := 0; i < job.Capacity; i++ {
-		worker, err := man.createWorker()
-		if err != nil {
-			errors = append(errors, err.Error())
-		} else {
-			job.Workers[worker.Id] = worker
+// sendOutputProgress reports a WorkerCommandOutput event on progress, if one
+// was given.
+func sendOutputProgress(progress chan<- WorkerEvent, jobID, workerID, output string) {
+	if progress == nil {
+		return
+	}
+	progress <- WorkerEvent{JobId: jobID, WorkerId: workerID, State: WorkerCommandOutput, Output: output}
+}
 
-			// Now that the worker is created, we tell it to start working
-			man.startWorker(worker)
-		}
+// Tag keys stamped on every instance a Manager creates, so instances can be
+// traced back to the job and owner that requested them, and reaped if that
+// job no longer exists.
+const (
+	tagName        = "Name"
+	tagDescription = "Description"
+	tagJobID       = "ccassignment:job-id"
+	tagOwnerEmail  = "ccassignment:owner-email"
+	tagCreatedAt   = "ccassignment:created-at"
+)
+
+// LaunchWithTags starts a new VM instance for job, stamped with Name,
+// Description and job-identifying tags, and returns once the instance has
+// been created. It does not wait for the instance to be running;
+// provisionWorker's StepWaitForInstance does that as part of the pipeline.
+// The tags let ReapOrphans find and clean up the instance later, even if
+// this Manager process crashes before the job finishes.
+func (man *Manager) LaunchWithTags(ctx context.Context, job *Job) (*Worker, error) {
+	tags := map[string]string{
+		tagName:        fmt.Sprintf("ccassignment-%s", job.Id),
+		tagDescription: fmt.Sprintf("Worker for CCAssignment job %q (%s)", job.Id, job.Name),
+		tagJobID:       job.Id,
+		tagOwnerEmail:  job.Email,
+		tagCreatedAt:   time.Now().UTC().Format(time.RFC3339),
 	}
 
-	if len(errors) > 0 {
-		return fmt.Errorf(strings.Join(errors, "; "))
+	inst, err := man.Client.RunInstance(ctx, tags)
+	if err != nil {
+		return nil, err
 	}
 
-	// Job was successfully started, add it to the manager
-	man.Jobs[job.Id] = job
-	return nil
+	return &Worker{
+		Id: inst.Id,
+	}, nil
 }
 
-// StopJob stops a job and stops all its associated workers.
-func (man *Manager) StopJob(job *Job) error {
-	fmt.Printf("%s: stopping job.\n", job.Id)
-	var errors []string
+// ReapOrphans terminates any instance tagged as belonging to this system
+// that is older than maxAge or whose job no longer exists in man.Jobs. This
+// cleans up instances left running if the Manager process crashed mid-job.
+func (man *Manager) ReapOrphans(ctx context.Context, maxAge time.Duration) error {
+	instances, err := man.Client.ListInstancesByTag(ctx, tagJobID)
+	if err != nil {
+		return err
+	}
 
-	// Stop all workers
-	for _, v := range job.Workers {
-		err := /*go*/ man.stopWorker(v)
-		if err != nil {
-			errors = append(errors, err.Error())
-		}
+	man.mu.RLock()
+	knownJobs := make(map[string]struct{}, len(man.Jobs))
+	for id := range man.Jobs {
+		knownJobs[id] = struct{}{}
 	}
+	man.mu.RUnlock()
+
+	var errs []error
+	for _, inst := range instances {
+		jobID := inst.Tags[tagJobID]
 
-	if len(errors) > 0 {
-		return fmt.Errorf(strings.Join(errors, "; "))
+		orphaned := false
+		if _, exists := knownJobs[jobID]; !exists {
+			orphaned = true
+		} else if createdAt, err := time.Parse(time.RFC3339, inst.Tags[tagCreatedAt]); err == nil && time.Since(createdAt) > maxAge {
+			orphaned = true
+		}
+		if !orphaned {
+			continue
+		}
+
+		fmt.Printf("%s: reaping orphaned instance (job %q).\n", inst.Id, jobID)
+		if err := man.Client.TerminateInstance(ctx, inst.Id); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	// Job was successfully terminated, remove it from the manager
-	delete(man.Jobs, job.Id)
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
 	return nil
 }
 
-// createInstance creates and returns an EC2 instance.
-func (man *Manager) createInstance() (*ec2.Instance, error) {
-	params := &ec2.RunInstancesInput{
-		ImageId:          aws.String(os.Getenv("IMG_ID")),
-		InstanceType:     aws.String(os.Getenv("INST_TYPE")),
-		MaxCount:         aws.Int64(1),
-		MinCount:         aws.Int64(1),
-		KeyName:          aws.String(os.Getenv("PEM_NAME")),
-		SecurityGroupIds: []*string{aws.String(os.Getenv("SEC_GROUP"))},
-	}
-	res, err := man.EC2Svc.RunInstances(params)
-	if err != nil {
-		return nil, err
-	}
+// startWorker provisions the Worker over SSH by running the job's pipeline of
+// steps: waiting for the instance and for SSH to come up and uploading any
+// files. It passes no commands, so none are run and there is no output to
+// collect. A half-provisioned instance is terminated on failure.
+func (man *Manager) startWorker(ctx context.Context, job *Job, w *Worker, progress chan<- WorkerEvent) error {
+	ctx, cancel := jobSSHContext(ctx, job)
+	defer cancel()
 
-	inst := res.Instances[0]
-	fmt.Printf("%s: created new instance.\n", *inst.InstanceId)
-	return inst, nil
+	_, err := man.provision(ctx, job, w, nil, progress)
+	return err
 }
 
-// runCmd runs a command on a worker instance through SSH.
-func (man *Manager) runCommand(worker *Worker, cmd string) (*string, error) {
-	inst, err := man.getWorkerInstance(worker)
-	if err != nil {
-		return nil, err
+// jobSSHContext derives a context bounded by job.Timelimit, the per-job SSH
+// timeout. A Timelimit of zero (or less) means no timelimit was set, so only
+// a cancellable child of the parent context, with no deadline of its own, is
+// returned instead of producing an already-expired deadline.
+func jobSSHContext(ctx context.Context, job *Job) (context.Context, context.CancelFunc) {
+	if job.Timelimit <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, time.Duration(job.Timelimit)*time.Second)
+}
 
-	// Open PEM file
-	pemPath := os.Getenv("PEM_PATH")
-	pemBytes, err := ioutil.ReadFile(pemPath)
-	if err != nil {
-		return nil, err
+// provisionWorker runs the SSH provisioning pipeline for a worker and
+// returns the output of each command that was run. Steps that reach SSH
+// milestones (StepWaitForSSH, StepRunCommands) report them on progress,
+// which may be nil.
+func (man *Manager) provisionWorker(ctx context.Context, job *Job, w *Worker, commands []string, progress chan<- WorkerEvent) ([]string, error) {
+	state := multistep.NewBasicStateBag()
+	state.Put("manager", man)
+	state.Put("worker", w)
+	state.Put("commands", commands)
+	state.Put("progress", progress)
+	state.Put("jobId", job.Id)
+
+	runner := &multistep.Runner{
+		Steps: []multistep.Step{
+			&StepTerminateOnFailure{},
+			&StepWaitForInstance{},
+			&StepWaitForSSH{},
+			&StepUploadFiles{},
+			&StepRunCommands{},
+			&StepCollectResults{},
+		},
 	}
+	runner.Run(ctx, state)
 
-	// Obtain private key
-	signer, err := ssh.ParsePrivateKey(pemBytes)
-	if err != nil {
-		return nil, err
+	if errVal, ok := state.GetOk("error"); ok {
+		return nil, errVal.(error)
 	}
 
-	// Connect to the remote server and perform the SSH handshake
-	config := &ssh.ClientConfig{
-		User:    "ubuntu",
-		Auth:    []ssh.AuthMethod{ssh.PublicKeys(signer)},
-		Timeout: 5 * time.Second,
-	}
-	fmt.Printf("%s: executing command: %s\n", *inst.InstanceId, cmd)
-	addr := fmt.Sprintf("%s:%d", *inst.PublicIpAddress, 22)
-
-	// Retry SSH until successful
-	var conn *ssh.Client
-	try, max, interval := 1, 5, 10*time.Second
-	for conn == nil && try <= max {
-		conn, err = ssh.Dial("tcp", addr, config)
-		if err != nil {
-			// Timeout occurred
-			fmt.Printf("%v (%d/%d), trying again in %v...\n", err, try, max, interval)
-			time.Sleep(interval)
-		}
-		try++
-	}
-	defer conn.Close()
+	results, _ := state.Get("results").([]string)
+	return results, nil
+}
 
-	session, err := conn.NewSession()
-	if err != nil {
-		return nil, err
+// stopWorker stops a worker (running VM instance).
+func (man *Manager) stopWorker(ctx context.Context, worker *Worker) error {
+	fmt.Printf("%s: stopping worker.\n", worker.Id)
+	return man.Client.TerminateInstance(ctx, worker.Id)
+}
+
+// StartJob starts a job and starts the necessary workers, launching them
+// concurrently (bounded by MaxParallelLaunches) instead of one at a time. If
+// any worker fails to launch, the workers that were already created are
+// rolled back (terminated) so the failure doesn't leak running instances.
+// Worker state transitions are reported on progress, which may be nil.
+// Cancelling ctx aborts any in-flight launches.
+//
+// The job is registered in man.Jobs before any worker is launched, not only
+// on success, so ReapOrphans can tell an instance that's still launching
+// apart from a truly orphaned one (whose job was never registered at all).
+func (man *Manager) StartJob(ctx context.Context, job *Job, progress chan<- WorkerEvent) error {
+	fmt.Printf("%s: starting job.\n", job.Id)
+
+	man.mu.Lock()
+	man.Jobs[job.Id] = job
+	man.mu.Unlock()
+
+	sem := make(chan struct{}, man.maxParallelLaunches())
+	g, gctx := errgroup.WithContext(ctx)
+
+	var errsMu sync.Mutex
+	var errs []error
+
+	// Create and start a number of Workers equal to the capacity of the job
+	for i := 0; i < job.Capacity; i++ {
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+			defer func() { <-sem }()
+
+			worker, err := man.LaunchWithTags(gctx, job)
+			if err != nil {
+				errsMu.Lock()
+				errs = append(errs, err)
+				errsMu.Unlock()
+				sendProgress(progress, job.Id, "", WorkerFailed, err)
+				return err
+			}
+
+			man.mu.Lock()
+			job.Workers[worker.Id] = worker
+			man.mu.Unlock()
+			sendProgress(progress, job.Id, worker.Id, WorkerCreated, nil)
+
+			// Now that the worker is created, we tell it to start working
+			if err := man.startWorker(gctx, job, worker, progress); err != nil {
+				errsMu.Lock()
+				errs = append(errs, err)
+				errsMu.Unlock()
+				sendProgress(progress, job.Id, worker.Id, WorkerFailed, err)
+				return err
+			}
+			return nil
+		})
 	}
 
-	defer session.Close()
-	var stdoutBuf bytes.Buffer
-	session.Stdout = &stdoutBuf
-	err = session.Run(cmd)
-	if err != nil {
-		return nil, err
+	if err := g.Wait(); err != nil {
+		man.mu.Lock()
+		workers := job.Workers
+		job.Workers = make(map[string]*Worker)
+		delete(man.Jobs, job.Id)
+		man.mu.Unlock()
+
+		if rollbackErr := man.terminateWorkers(ctx, job.Id, workers, progress); rollbackErr != nil {
+			fmt.Printf("%s: rollback after failed start also failed: %v\n", job.Id, rollbackErr)
+		}
+		return errors.Join(errs...)
 	}
 
-	return aws.String(stdoutBuf.String()), nil
+	return nil
 }
 
-// getWorkerInstance returns the AWS instance corresponding to a worker
-func (man *Manager) getWorkerInstance(w *Worker) (*ec2.Instance, error) {
-	params := &ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{
-			&ec2.Filter{
-				Name:   aws.String("instance-id"),
-				Values: []*string{aws.String(w.Id)},
-			},
-		},
+// StopJob stops a job and stops all its associated workers concurrently
+// (bounded by MaxParallelLaunches). Cancelling ctx aborts any in-flight
+// terminations.
+func (man *Manager) StopJob(ctx context.Context, job *Job) error {
+	fmt.Printf("%s: stopping job.\n", job.Id)
+
+	man.mu.RLock()
+	workers := make(map[string]*Worker, len(job.Workers))
+	for id, w := range job.Workers {
+		workers[id] = w
 	}
+	man.mu.RUnlock()
 
-	resp, err := man.EC2Svc.DescribeInstances(params)
-	if err != nil {
-		return nil, err
+	if err := man.terminateWorkers(ctx, job.Id, workers, nil); err != nil {
+		return err
 	}
 
-	for _, res := range resp.Reservations {
-		for _, inst := range res.Instances {
-			return inst, err
-		}
+	// Job was successfully terminated, remove it from the manager
+	man.mu.Lock()
+	delete(man.Jobs, job.Id)
+	man.mu.Unlock()
+	return nil
+}
+
+// terminateWorkers tears down workers concurrently, bounded by
+// MaxParallelLaunches, and aggregates any errors into a single error.
+func (man *Manager) terminateWorkers(ctx context.Context, jobID string, workers map[string]*Worker, progress chan<- WorkerEvent) error {
+	sem := make(chan struct{}, man.maxParallelLaunches())
+
+	var g errgroup.Group
+	var mu sync.Mutex
+	var errs []error
+
+	for _, w := range workers {
+		worker := w
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if err := man.stopWorker(ctx, worker); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return err
+			}
+			sendProgress(progress, jobID, worker.Id, WorkerTerminated, nil)
+			return nil
+		})
 	}
+	g.Wait()
 
-	return nil, fmt.Errorf("Could not find running instance.")
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return nil
 }
 
 // JobFromRecord converts a DynamoDB record to a Job
@@ -240,20 +438,11 @@ func JobFromRecord(rec *Record) *Job {
 	}
 }
 
-// Runs a list of commands on a Worker.
-func (man *Manager) runCommands(worker *Worker, commands []string) error {
-	for _, cmd := range commands {
-		res, err := man.runCommand(worker, cmd)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
+// runCommands runs a list of commands on a Worker, honoring the job's SSH
+// timeout, and returns their collected output.
+func (man *Manager) runCommands(ctx context.Context, job *Job, worker *Worker, commands []string, progress chan<- WorkerEvent) ([]string, error) {
+	ctx, cancel := jobSSHContext(ctx, job)
+	defer cancel()
 
-// check panics if err is not nil
-func check(err error) {
-	if err != nil {
-		panic(err)
-	}
+	return man.provision(ctx, job, worker, commands, progress)
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nov1n/CCAssignment/src/cloud"
+)
+
+var errTest = errors.New("test error")
+
+func newTestJob(id string, capacity int) *Job {
+	return &Job{
+		Id:       id,
+		Capacity: capacity,
+		Workers:  make(map[string]*Worker),
+	}
+}
+
+// stubProvision makes man.StartJob/StopJob exercisable without a real SSH
+// server: FakeClient instances never accept SSH connections, so the real
+// provisioning pipeline would fail StepWaitForSSH every time.
+func stubProvision(man *Manager, err error) {
+	man.provision = func(ctx context.Context, job *Job, w *Worker, commands []string, progress chan<- WorkerEvent) ([]string, error) {
+		return nil, err
+	}
+}
+
+func TestLaunchWithTags(t *testing.T) {
+	man := NewManager(cloud.NewFakeClient())
+	job := newTestJob("job-launch", 1)
+
+	worker, err := man.LaunchWithTags(context.Background(), job)
+	if err != nil {
+		t.Fatalf("LaunchWithTags returned error: %v", err)
+	}
+	if worker.Id == "" {
+		t.Fatalf("expected worker to have an id")
+	}
+
+	inst, err := man.Client.DescribeInstance(context.Background(), worker.Id)
+	if err != nil {
+		t.Fatalf("DescribeInstance returned error: %v", err)
+	}
+	if inst.Tags[tagJobID] != job.Id {
+		t.Fatalf("expected instance to be tagged with job id %q, got %q", job.Id, inst.Tags[tagJobID])
+	}
+}
+
+func TestLaunchWithTagsRunError(t *testing.T) {
+	fake := cloud.NewFakeClient()
+	fake.RunInstanceErr = errTest
+	man := NewManager(fake)
+
+	if _, err := man.LaunchWithTags(context.Background(), newTestJob("job-launch-err", 1)); err != errTest {
+		t.Fatalf("expected %v, got %v", errTest, err)
+	}
+}
+
+func TestReapOrphansTerminatesUnknownJobs(t *testing.T) {
+	fake := cloud.NewFakeClient()
+	man := NewManager(fake)
+
+	knownJob := newTestJob("known-job", 1)
+	man.Jobs[knownJob.Id] = knownJob
+	known, err := man.LaunchWithTags(context.Background(), knownJob)
+	if err != nil {
+		t.Fatalf("LaunchWithTags returned error: %v", err)
+	}
+	knownJob.Workers[known.Id] = known
+
+	orphan, err := man.LaunchWithTags(context.Background(), newTestJob("vanished-job", 1))
+	if err != nil {
+		t.Fatalf("LaunchWithTags returned error: %v", err)
+	}
+
+	if err := man.ReapOrphans(context.Background(), time.Hour); err != nil {
+		t.Fatalf("ReapOrphans returned error: %v", err)
+	}
+
+	if !fake.IsTerminated(orphan.Id) {
+		t.Fatalf("expected orphaned instance to be terminated")
+	}
+	if fake.IsTerminated(known.Id) {
+		t.Fatalf("expected known job's instance to survive reaping")
+	}
+}
+
+func TestStartJobCreatesWorkersForCapacity(t *testing.T) {
+	man := NewManager(cloud.NewFakeClient())
+	stubProvision(man, nil)
+	job := newTestJob("job-1", 3)
+
+	if err := man.StartJob(context.Background(), job, nil); err != nil {
+		t.Fatalf("StartJob returned error: %v", err)
+	}
+	if len(job.Workers) != 3 {
+		t.Fatalf("expected 3 workers, got %d", len(job.Workers))
+	}
+	if _, ok := man.Jobs[job.Id]; !ok {
+		t.Fatalf("expected job to be registered with the manager")
+	}
+}
+
+func TestStartJobReturnsErrorOnFailure(t *testing.T) {
+	fake := cloud.NewFakeClient()
+	fake.RunInstanceErr = errTest
+	man := NewManager(fake)
+	job := newTestJob("job-2", 2)
+
+	if err := man.StartJob(context.Background(), job, nil); err == nil {
+		t.Fatalf("expected StartJob to return an error")
+	}
+	if _, ok := man.Jobs[job.Id]; ok {
+		t.Fatalf("job should not be registered when StartJob fails")
+	}
+	if len(job.Workers) != 0 {
+		t.Fatalf("expected workers to be rolled back, got %d", len(job.Workers))
+	}
+}
+
+func TestStartJobRollsBackWorkersWhenProvisioningFails(t *testing.T) {
+	fake := cloud.NewFakeClient()
+	man := NewManager(fake)
+	stubProvision(man, errTest)
+	job := newTestJob("job-provision-fail", 2)
+
+	if err := man.StartJob(context.Background(), job, nil); err == nil {
+		t.Fatalf("expected StartJob to return an error")
+	}
+	if _, ok := man.Jobs[job.Id]; ok {
+		t.Fatalf("job should not be registered when StartJob fails")
+	}
+	if len(job.Workers) != 0 {
+		t.Fatalf("expected workers to be rolled back, got %d", len(job.Workers))
+	}
+
+	instances, err := fake.ListInstancesByTag(context.Background(), tagJobID)
+	if err != nil {
+		t.Fatalf("ListInstancesByTag returned error: %v", err)
+	}
+	found := 0
+	for _, inst := range instances {
+		if inst.Tags[tagJobID] != job.Id {
+			continue
+		}
+		found++
+		if !fake.IsTerminated(inst.Id) {
+			t.Fatalf("expected instance %q to be terminated after a failed provision", inst.Id)
+		}
+	}
+	// The first failed provision cancels the group, so the other launch may
+	// or may not have created its instance by then.
+	if found < 1 || found > 2 {
+		t.Fatalf("expected 1 or 2 instances tagged for %q, found %d", job.Id, found)
+	}
+}
+
+func TestStopJobTerminatesWorkers(t *testing.T) {
+	fake := cloud.NewFakeClient()
+	man := NewManager(fake)
+	stubProvision(man, nil)
+	job := newTestJob("job-3", 2)
+
+	if err := man.StartJob(context.Background(), job, nil); err != nil {
+		t.Fatalf("StartJob returned error: %v", err)
+	}
+	if err := man.StopJob(context.Background(), job); err != nil {
+		t.Fatalf("StopJob returned error: %v", err)
+	}
+	if _, ok := man.Jobs[job.Id]; ok {
+		t.Fatalf("expected job to be removed from the manager")
+	}
+	for id := range job.Workers {
+		if !fake.IsTerminated(id) {
+			t.Fatalf("expected worker %q to be terminated", id)
+		}
+	}
+}
+
+func TestStopJobReturnsErrorOnFailure(t *testing.T) {
+	fake := cloud.NewFakeClient()
+	man := NewManager(fake)
+	stubProvision(man, nil)
+	job := newTestJob("job-4", 1)
+
+	if err := man.StartJob(context.Background(), job, nil); err != nil {
+		t.Fatalf("StartJob returned error: %v", err)
+	}
+
+	fake.TerminateInstanceErr = errTest
+	if err := man.StopJob(context.Background(), job); err == nil {
+		t.Fatalf("expected StopJob to return an error")
+	}
+}
@@ -0,0 +1,91 @@
+// Package multistep implements a very small state-machine runner for
+// composing provisioning logic out of discrete, retryable steps, in the
+// style of packer's multistep package.
+package multistep
+
+import "context"
+
+// StepAction is returned by a Step to tell the Runner whether to proceed to
+// the next step or halt the whole pipeline.
+type StepAction int
+
+const (
+	// ActionContinue tells the Runner to move on to the next step.
+	ActionContinue StepAction = iota
+	// ActionHalt tells the Runner to stop running steps and begin cleanup.
+	ActionHalt
+)
+
+// StateBag is the data shared between the steps of a pipeline.
+type StateBag interface {
+	Get(key string) interface{}
+	GetOk(key string) (interface{}, bool)
+	Put(key string, value interface{})
+}
+
+// BasicStateBag is a StateBag backed by a plain map. It is not safe for
+// concurrent use; steps in a single Runner are expected to run sequentially.
+type BasicStateBag struct {
+	data map[string]interface{}
+}
+
+// NewBasicStateBag returns a new, empty BasicStateBag.
+func NewBasicStateBag() *BasicStateBag {
+	return &BasicStateBag{data: make(map[string]interface{})}
+}
+
+// Get returns the value for key, or nil if it isn't set.
+func (s *BasicStateBag) Get(key string) interface{} {
+	return s.data[key]
+}
+
+// GetOk returns the value for key and whether it was set.
+func (s *BasicStateBag) GetOk(key string) (interface{}, bool) {
+	v, ok := s.data[key]
+	return v, ok
+}
+
+// Put stores value under key.
+func (s *BasicStateBag) Put(key string, value interface{}) {
+	s.data[key] = value
+}
+
+// Step is a single unit of work in a pipeline. Run should honor ctx
+// cancellation and return ActionHalt (after putting an "error" key in the
+// state) if it cannot proceed. Cleanup is called for every step the Runner
+// reached, in reverse order, once the pipeline finishes or halts.
+type Step interface {
+	Run(ctx context.Context, state StateBag) StepAction
+	Cleanup(state StateBag)
+}
+
+// Runner runs a fixed sequence of Steps against a shared StateBag.
+type Runner struct {
+	Steps []Step
+}
+
+// Run executes the steps in order, stopping at the first one that returns
+// ActionHalt or whose context is cancelled. Cleanup is invoked for every
+// step that was reached, in reverse order, regardless of outcome; this
+// includes a step that was skipped because the context was already
+// cancelled.
+func (r *Runner) Run(ctx context.Context, state StateBag) {
+	ran := make([]Step, 0, len(r.Steps))
+
+	for _, step := range r.Steps {
+		ran = append(ran, step)
+
+		if ctx.Err() != nil {
+			state.Put("error", ctx.Err())
+			break
+		}
+
+		if action := step.Run(ctx, state); action == ActionHalt {
+			break
+		}
+	}
+
+	for i := len(ran) - 1; i >= 0; i-- {
+		ran[i].Cleanup(state)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/nov1n/CCAssignment/src/cloud"
+	"github.com/nov1n/CCAssignment/src/multistep"
+)
+
+// sshRetryInterval is how long a StepWaitForSSH waits between dial attempts.
+const sshRetryInterval = 10 * time.Second
+
+// terminateOnFailureTimeout bounds the cleanup termination call made by
+// StepTerminateOnFailure, independent of the pipeline's own context.
+const terminateOnFailureTimeout = 30 * time.Second
+
+// stateProgress reads the progress channel and job/worker ids a step needs
+// to report an event, as put in the state bag by provisionWorker.
+func stateProgress(state multistep.StateBag) (progress chan<- WorkerEvent, jobID, workerID string) {
+	progress, _ = state.Get("progress").(chan<- WorkerEvent)
+	jobID, _ = state.Get("jobId").(string)
+	workerID = state.Get("worker").(*Worker).Id
+	return progress, jobID, workerID
+}
+
+// StepWaitForInstance waits for a worker's instance to be running and stores
+// it in the state bag under "instance".
+type StepWaitForInstance struct{}
+
+// Run implements multistep.Step.
+func (s *StepWaitForInstance) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	man := state.Get("manager").(*Manager)
+	worker := state.Get("worker").(*Worker)
+
+	fmt.Printf("%s: waiting to be ready...\n", worker.Id)
+	if err := man.Client.WaitUntilRunning(ctx, worker.Id); err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	inst, err := man.Client.DescribeInstance(ctx, worker.Id)
+	if err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	fmt.Printf("%s: instance ready.\n", worker.Id)
+	state.Put("instance", inst)
+	return multistep.ActionContinue
+}
+
+// Cleanup implements multistep.Step.
+func (s *StepWaitForInstance) Cleanup(state multistep.StateBag) {}
+
+// StepWaitForSSH dials the instance over SSH, retrying until it succeeds, the
+// context is cancelled, or the per-job timeout is reached. The resulting
+// client is stored in the state bag under "conn".
+type StepWaitForSSH struct{}
+
+// Run implements multistep.Step.
+func (s *StepWaitForSSH) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	inst := state.Get("instance").(*cloud.Instance)
+
+	pemBytes, err := ioutil.ReadFile(os.Getenv("PEM_PATH"))
+	if err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	config := &ssh.ClientConfig{
+		User:    "ubuntu",
+		Auth:    []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		Timeout: 5 * time.Second,
+	}
+	addr := fmt.Sprintf("%s:%d", inst.PublicIPAddress, 22)
+
+	for {
+		conn, err := ssh.Dial("tcp", addr, config)
+		if err == nil {
+			state.Put("conn", conn)
+			progress, jobID, workerID := stateProgress(state)
+			sendProgress(progress, jobID, workerID, WorkerSSHReady, nil)
+			return multistep.ActionContinue
+		}
+
+		fmt.Printf("%v, trying again in %v...\n", err, sshRetryInterval)
+
+		select {
+		case <-ctx.Done():
+			state.Put("error", ctx.Err())
+			return multistep.ActionHalt
+		case <-time.After(sshRetryInterval):
+		}
+	}
+}
+
+// Cleanup implements multistep.Step.
+func (s *StepWaitForSSH) Cleanup(state multistep.StateBag) {
+	if conn, ok := state.GetOk("conn"); ok {
+		conn.(*ssh.Client).Close()
+	}
+}
+
+// StepUploadFiles uploads the "files" map (local path -> remote path), if
+// one was put in the state bag, before any commands run.
+type StepUploadFiles struct{}
+
+// Run implements multistep.Step.
+func (s *StepUploadFiles) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	files, ok := state.GetOk("files")
+	if !ok {
+		return multistep.ActionContinue
+	}
+
+	conn := state.Get("conn").(*ssh.Client)
+	for local, remote := range files.(map[string]string) {
+		if err := uploadFile(conn, local, remote); err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+// Cleanup implements multistep.Step.
+func (s *StepUploadFiles) Cleanup(state multistep.StateBag) {}
+
+func uploadFile(conn *ssh.Client, local, remote string) error {
+	content, err := ioutil.ReadFile(local)
+	if err != nil {
+		return err
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := session.Start(fmt.Sprintf("cat > %s", remote)); err != nil {
+		return err
+	}
+	if _, err := stdin.Write(content); err != nil {
+		return err
+	}
+	stdin.Close()
+
+	return session.Wait()
+}
+
+// StepRunCommands runs the "commands" ([]string) from the state bag in
+// order over the SSH connection, halting on the first failure.
+type StepRunCommands struct{}
+
+// Run implements multistep.Step.
+func (s *StepRunCommands) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	conn := state.Get("conn").(*ssh.Client)
+	commands, _ := state.Get("commands").([]string)
+	progress, jobID, workerID := stateProgress(state)
+
+	outputs := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		session, err := conn.NewSession()
+		if err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+
+		var stdoutBuf bytes.Buffer
+		session.Stdout = &stdoutBuf
+
+		fmt.Printf("executing command: %s\n", cmd)
+		err = session.Run(cmd)
+		session.Close()
+		if err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+
+		outputs = append(outputs, stdoutBuf.String())
+		sendOutputProgress(progress, jobID, workerID, stdoutBuf.String())
+	}
+
+	state.Put("outputs", outputs)
+	return multistep.ActionContinue
+}
+
+// Cleanup implements multistep.Step.
+func (s *StepRunCommands) Cleanup(state multistep.StateBag) {}
+
+// StepCollectResults copies the "outputs" gathered by StepRunCommands into
+// "results", the key callers of the pipeline read the final output from.
+type StepCollectResults struct{}
+
+// Run implements multistep.Step.
+func (s *StepCollectResults) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	outputs, _ := state.Get("outputs").([]string)
+	state.Put("results", outputs)
+	return multistep.ActionContinue
+}
+
+// Cleanup implements multistep.Step.
+func (s *StepCollectResults) Cleanup(state multistep.StateBag) {}
+
+// StepTerminateOnFailure terminates the worker's instance once the pipeline
+// finishes if any step recorded an error, so a half-provisioned instance
+// never leaks.
+type StepTerminateOnFailure struct{}
+
+// Run implements multistep.Step.
+func (s *StepTerminateOnFailure) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	return multistep.ActionContinue
+}
+
+// Cleanup implements multistep.Step.
+func (s *StepTerminateOnFailure) Cleanup(state multistep.StateBag) {
+	if _, ok := state.GetOk("error"); !ok {
+		return
+	}
+
+	man := state.Get("manager").(*Manager)
+	worker := state.Get("worker").(*Worker)
+	fmt.Printf("%s: provisioning failed, terminating instance.\n", worker.Id)
+
+	// The pipeline's own context may already be the reason we're cleaning
+	// up (e.g. it timed out), so termination gets a fresh one.
+	ctx, cancel := context.WithTimeout(context.Background(), terminateOnFailureTimeout)
+	defer cancel()
+	man.Client.TerminateInstance(ctx, worker.Id)
+}